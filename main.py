@@ -1,29 +1,605 @@
+import hashlib
+import inspect
+import json
+import os
+import re
+import subprocess
+import sys
+import time
+from collections import Counter
+from concurrent.futures import ProcessPoolExecutor, wait
+from enum import Enum
+from fnmatch import fnmatch
+from functools import lru_cache, partial
+from pathlib import Path
+from typing import List, Optional, Set, Tuple
+
+import libcst as cst
 import typer
 from rich import print
 
-from parser.parse import get_ast
+from parser.parse import parse_code
+
+# Directories that are never worth scanning; --exclude adds to these
+DEFAULT_EXCLUDES = [
+    ".git",
+    ".venv",
+    "venv",
+    "node_modules",
+    "__pycache__",
+    "build",
+    "dist",
+]
+
+# Header markers that flag a file as generated; only the first lines are checked
+GENERATED_MARKERS = ("@generated", "DO NOT EDIT", "Code generated")
+GENERATED_HEADER_LINES = 5
+
+# Parse results for --cache, keyed by cache_key(); relative to where agree runs
+CACHE_DIR = Path(".agree") / "cache"
+
+
+class UnpairedPolicy(str, Enum):
+    """How to treat a target that only one class is agreed under"""
+
+    error = "error"
+    warning = "warning"
+    ignore = "ignore"
+
+
+@lru_cache(maxsize=None)
+def glob_to_regex(pattern: str) -> re.Pattern:
+    """
+    Compile a path glob where '*' and '?' stay within one path segment and
+    '**' spans any number of them, so 'src/**/*.py' matches both
+    'src/a.py' and 'src/pkg/b.py'.
+    """
+    regex = ""
+    i = 0
+    while i < len(pattern):
+        if pattern.startswith("**/", i):
+            regex += "(?:.*/)?"
+            i += 3
+        elif pattern.startswith("**", i):
+            regex += ".*"
+            i += 2
+        elif pattern[i] == "*":
+            regex += "[^/]*"
+            i += 1
+        elif pattern[i] == "?":
+            regex += "[^/]"
+            i += 1
+        elif pattern[i] == "[" and "]" in pattern[i + 2 :]:
+            end = pattern.index("]", i + 2)
+            body = pattern[i + 1 : end]
+            if body.startswith("!"):
+                body = "^" + body[1:]
+            regex += "[" + body.replace("\\", "\\\\") + "]"
+            i = end + 1
+        else:
+            regex += re.escape(pattern[i])
+            i += 1
+    return re.compile(regex + r"\Z")
+
+
+def matches_any(rel_path: str, patterns: List[str]) -> bool:
+    """
+    Check a relative posix path against glob patterns.
+
+    Patterns containing a '/' are matched against the whole relative path
+    (e.g. 'src/**/*.py'), anything else against each path component
+    (e.g. '*.py', 'node_modules').
+    """
+    parts = rel_path.split("/")
+    for pattern in patterns:
+        if "/" in pattern:
+            if glob_to_regex(pattern).match(rel_path):
+                return True
+        elif any(fnmatch(part, pattern) for part in parts):
+            return True
+    return False
+
+
+def error_record(
+    path: str, message: str, line: Optional[int] = None, column: Optional[int] = None
+) -> dict:
+    """
+    Build an error for a path; line/column are 1-based and only set when the
+    error points at a place in the file, e.g. a syntax error.
+    """
+    return {"path": path, "line": line, "column": column, "message": message}
+
+
+def collect_files(
+    paths: List[str], include: List[str], exclude: List[str]
+) -> Tuple[List[Path], List[dict]]:
+    """
+    Walk the given files/directories and return the files to parse, plus
+    an error record for every path that doesn't exist.
+
+    Files passed explicitly are always kept; files found by walking a
+    directory must match an include pattern and no exclude pattern. A file
+    reached through more than one path is only returned once.
+    """
+    excludes = DEFAULT_EXCLUDES + exclude
+    files: List[Path] = []
+    errors: List[dict] = []
+    seen: Set[Path] = set()
+
+    def add(file_path: Path) -> None:
+        if file_path.resolve() not in seen:
+            seen.add(file_path.resolve())
+            files.append(file_path)
 
+    for root in paths:
+        root_path = Path(root)
+        if root_path.is_file():
+            add(root_path)
+            continue
+        if not root_path.is_dir():
+            errors.append(error_record(root, "not found"))
+            continue
 
-def extract_text_from_test():
-    """Extract text from test.py using hardcoded path"""
-    test_file_path = "test.py"
+        for dirpath, dirnames, filenames in os.walk(root_path):
+            rel_dir = Path(dirpath).relative_to(root_path).as_posix()
+            # Prune excluded directories so we never descend into them
+            dirnames[:] = sorted(
+                d
+                for d in dirnames
+                if not matches_any(
+                    d if rel_dir == "." else f"{rel_dir}/{d}", excludes
+                )
+            )
+            for filename in sorted(filenames):
+                rel_path = filename if rel_dir == "." else f"{rel_dir}/{filename}"
+                if matches_any(rel_path, include) and not matches_any(
+                    rel_path, excludes
+                ):
+                    add(Path(dirpath) / filename)
 
+    return files, errors
+
+
+def changed_files() -> Optional[Set[Path]]:
+    """
+    Files modified, staged, or untracked according to git, as resolved
+    paths. Returns None if git isn't available or this isn't a repository.
+    """
+    # -z keeps non-ASCII paths verbatim instead of quoting them
+    commands = [
+        ["git", "diff", "--name-only", "-z", "HEAD"],
+        ["git", "ls-files", "--others", "--exclude-standard", "-z"],
+    ]
     try:
-        with open(test_file_path, "r", encoding="utf-8") as file:
-            text = file.read()
-        return text
-    except FileNotFoundError:
-        print(f"Error: File '{test_file_path}' not found")
+        root = subprocess.run(
+            ["git", "rev-parse", "--show-toplevel"],
+            capture_output=True,
+            text=True,
+            check=True,
+        ).stdout.strip()
+        files: Set[Path] = set()
+        for command in commands:
+            output = subprocess.run(
+                command, capture_output=True, text=True, check=True, cwd=root
+            ).stdout
+            files.update(
+                (Path(root) / name).resolve() for name in output.split("\0") if name
+            )
+        return files
+    except (OSError, subprocess.CalledProcessError) as e:
+        typer.echo(f"Error asking git for changed files: {e}", err=True)
         return None
+
+
+def is_generated(text: str) -> bool:
+    """Check the top of a file for a generated-code header"""
+    header = text.splitlines()[:GENERATED_HEADER_LINES]
+    return any(marker in line for line in header for marker in GENERATED_MARKERS)
+
+
+def read_file(file_path: Path) -> Tuple[Optional[str], Optional[dict]]:
+    """
+    Read a source file. On failure returns no text and an error record
+    (same shape as parse errors) instead of raising.
+    """
+    try:
+        with open(file_path, "r", encoding="utf-8") as file:
+            return file.read(), None
+    except (OSError, UnicodeDecodeError) as e:
+        return None, error_record(str(file_path), f"could not read file: {e}")
+
+
+def load_sources(
+    file_paths: List[Path], max_file_size: float, skip_generated: bool
+) -> Tuple[List[Tuple[str, str]], List[Tuple[Path, str]], List[dict]]:
+    """
+    Read the files to parse, returning (path, text) sources, skipped files
+    with the reason, and error records for files that couldn't be read.
+    """
+    sources: List[Tuple[str, str]] = []
+    skipped: List[Tuple[Path, str]] = []
+    errors: List[dict] = []
+    for file_path in file_paths:
+        try:
+            size = file_path.stat().st_size
+        except OSError as e:
+            # e.g. a dangling symlink picked up while walking a directory
+            errors.append(error_record(str(file_path), f"could not read file: {e}"))
+            continue
+        if max_file_size and size > max_file_size * 1024 * 1024:
+            skipped.append((file_path, f"larger than {max_file_size:g} MB"))
+            continue
+        text, error = read_file(file_path)
+        if error is not None:
+            errors.append(error)
+            continue
+        if skip_generated and text and is_generated(text):
+            skipped.append((file_path, "generated"))
+            continue
+        sources.append((str(file_path), text))
+    return sources, skipped, errors
+
+
+def split_patterns(values: List[str]) -> List[str]:
+    """Flatten repeatable, comma-separated option values into patterns"""
+    return [p.strip() for value in values for p in value.split(",") if p.strip()]
+
+
+def filter_index(index: dict, models: List[str], fields: List[str]) -> dict:
+    """
+    Narrow the index to targets or classes matching any of the model globs,
+    and to fields matching any of the field globs. Empty lists keep all.
+    """
+    filtered: dict = {}
+    for target, classes in index.items():
+        for class_name, entry in classes.items():
+            if models and not any(
+                fnmatch(target, p) or fnmatch(class_name, p) for p in models
+            ):
+                continue
+            if fields:
+                entry = dict(entry)
+                for key in ("fields", "field_locations"):
+                    if key in entry:
+                        entry[key] = {
+                            name: value
+                            for name, value in entry[key].items()
+                            if any(fnmatch(name, p) for p in fields)
+                        }
+            filtered.setdefault(target, {})[class_name] = entry
+    return filtered
+
+
+def parse_source(
+    source: Tuple[str, Optional[str]], auto_discover: bool
+) -> Tuple[dict, Optional[dict]]:
+    """
+    Parse one (path, text) pair; runs in a worker process with --jobs.
+
+    Returns the file's index and, if it failed to parse, an error with the
+    path, 1-based line/column (syntax errors only), and message instead of
+    raising, so one bad file doesn't stop the rest of the scan.
+    """
+    source_path, text = source
+    if not text:
+        return {}, None
+    try:
+        return parse_code(text, auto_discover, source_path), None
+    except cst.ParserSyntaxError as e:
+        return {}, error_record(source_path, e.message, e.editor_line, e.editor_column)
+    # anything else the visitor trips over is still confined to this file
     except Exception as e:
-        print(f"Error reading file: {e}")
+        return {}, error_record(source_path, f"{type(e).__name__}: {e}")
+
+
+@lru_cache(maxsize=None)
+def parser_fingerprint() -> str:
+    """Hash of the parser's own source, so editing it invalidates the cache"""
+    digest = hashlib.sha256()
+    for module_path in sorted(Path(inspect.getfile(parse_code)).parent.glob("*.py")):
+        digest.update(module_path.read_bytes())
+    return digest.hexdigest()
+
+
+def cache_key(source: Tuple[str, Optional[str]], auto_discover: bool) -> str:
+    """
+    Key a source by parser version, options, path, and content; the path is
+    part of it because it ends up in the recorded locations.
+    """
+    source_path, text = source
+    digest = hashlib.sha256()
+    for part in (parser_fingerprint(), str(auto_discover), source_path, text or ""):
+        digest.update(part.encode("utf-8"))
+        digest.update(b"\0")
+    return digest.hexdigest()
+
+
+def read_cached(key: str) -> Optional[Tuple[dict, Optional[dict]]]:
+    """A cached (index, error) result, or None if it's missing or unreadable"""
+    try:
+        with open(CACHE_DIR / f"{key}.json", "r", encoding="utf-8") as file:
+            entry = json.load(file)
+        return entry["index"], entry["error"]
+    except (OSError, ValueError, KeyError, TypeError):
         return None
 
 
-def main():
-    text = extract_text_from_test()
-    if text:
-        get_ast(text)
+def write_cached(key: str, result: Tuple[dict, Optional[dict]]) -> None:
+    """Store a parse result; a cache that can't be written just costs a re-parse"""
+    index, error = result
+    path = CACHE_DIR / f"{key}.json"
+    # write then rename, so concurrent runs never read half a file
+    tmp_path = path.with_name(f"{path.name}.{os.getpid()}.tmp")
+    try:
+        CACHE_DIR.mkdir(parents=True, exist_ok=True)
+        with open(tmp_path, "w", encoding="utf-8") as file:
+            json.dump({"index": index, "error": error}, file)
+        os.replace(tmp_path, path)
+    except OSError:
+        pass
+
+
+def parse_sources(
+    sources: List[Tuple[str, Optional[str]]],
+    auto_discover: bool,
+    jobs: int,
+    deadline: Optional[float],
+    cache: bool = False,
+) -> Tuple[List[Tuple[dict, Optional[dict]]], List[str]]:
+    """
+    Parse every source, in a process pool with jobs > 1, reusing cached
+    results when cache is set. Once the time.perf_counter() deadline passes
+    no new file is started; returns the results in source order plus the
+    paths that were never parsed.
+    """
+    results: List[Optional[Tuple[dict, Optional[dict]]]] = [None] * len(sources)
+    keys = [cache_key(source, auto_discover) for source in sources] if cache else []
+    for i, key in enumerate(keys):
+        results[i] = read_cached(key)
+    pending = [i for i, result in enumerate(results) if result is None]
+
+    parse = partial(parse_source, auto_discover=auto_discover)
+    if jobs > 1 and len(pending) > 1:
+        with ProcessPoolExecutor(max_workers=jobs) as pool:
+            futures = {i: pool.submit(parse, sources[i]) for i in pending}
+            timeout = None
+            if deadline is not None:
+                timeout = max(deadline - time.perf_counter(), 0)
+            wait(futures.values(), timeout=timeout)
+            # files already being parsed finish; queued ones never start
+            for future in futures.values():
+                future.cancel()
+        for i, future in futures.items():
+            if not future.cancelled():
+                results[i] = future.result()
+    else:
+        for i in pending:
+            if deadline is not None and time.perf_counter() > deadline:
+                break
+            results[i] = parse(sources[i])
+
+    if cache:
+        for i in pending:
+            if results[i] is not None:
+                write_cached(keys[i], results[i])
+
+    # results stay in source order, so the index stays stable
+    unparsed = [sources[i][0] for i in pending if results[i] is None]
+    return [result for result in results if result is not None], unparsed
+
+
+def parse_duration(value: str) -> float:
+    """Seconds in a duration like '90', '60s', '2m' or '1h'"""
+    units = {"s": 1, "m": 60, "h": 3600}
+    number, unit = (value[:-1], value[-1]) if value[-1:] in units else (value, "s")
+    try:
+        seconds = float(number)
+    except ValueError:
+        seconds = -1
+    if seconds < 0:
+        raise typer.BadParameter(
+            f"'{value}' is not a duration like 60s or 2m", param_hint="'--timeout'"
+        )
+    return seconds * units[unit]
+
+
+def format_location(location: dict) -> str:
+    """Render a class or field location as path:line:column"""
+    return f"{location['path']}:{location['line']}:{location['column']}"
+
+
+def format_error(error: dict) -> str:
+    """Render an error record as path:line:column: message (or path: message)"""
+    if error["line"] is None:
+        return f"{error['path']}: {error['message']}"
+    return f"{error['path']}:{error['line']}:{error['column']}: {error['message']}"
+
+
+def main(
+    path: List[str] = typer.Option(
+        ["."],
+        "--path",
+        "-p",
+        help="File or directory to scan, or '-' for stdin (repeatable)",
+    ),
+    include: List[str] = typer.Option(
+        ["*.py"], "--include", help="Glob of files to parse (repeatable)"
+    ),
+    exclude: List[str] = typer.Option(
+        [], "--exclude", help="Glob of files or directories to skip (repeatable)"
+    ),
+    json_output: bool = typer.Option(
+        False, "--json", help="Print the index as JSON without timing"
+    ),
+    auto_discover: bool = typer.Option(
+        False,
+        "--auto-discover",
+        help="Also index undecorated BaseModel/Base subclasses, paired by name",
+    ),
+    jobs: int = typer.Option(
+        1, "--jobs", "-j", min=1, help="Number of processes to parse files with"
+    ),
+    changed_only: bool = typer.Option(
+        False,
+        "--changed-only",
+        help="Only parse files git reports as modified, staged, or untracked",
+    ),
+    max_file_size: float = typer.Option(
+        1.0,
+        "--max-file-size",
+        help="Skip files larger than this many MB (0 for no limit)",
+    ),
+    skip_generated: bool = typer.Option(
+        True,
+        "--skip-generated/--no-skip-generated",
+        help="Skip files with a generated-code header (@generated, DO NOT EDIT)",
+    ),
+    model: List[str] = typer.Option(
+        [],
+        "--model",
+        help="Only targets/classes matching these globs, e.g. 'User,Inv*'",
+    ),
+    field: List[str] = typer.Option(
+        [], "--field", help="Only fields matching these globs, e.g. 'email,*_at'"
+    ),
+    unpaired: UnpairedPolicy = typer.Option(
+        UnpairedPolicy.warning,
+        "--unpaired",
+        help=(
+            "Treat targets with only one class as an error, warning, or ignore "
+            "(at most a warning with --changed-only or an incomplete --timeout run)"
+        ),
+    ),
+    timeout: Optional[str] = typer.Option(
+        None,
+        "--timeout",
+        help=(
+            "Stop parsing after this long, e.g. 60s or 2m, and report partial "
+            "results (0 for no limit)"
+        ),
+    ),
+    cache: bool = typer.Option(
+        False,
+        "--cache",
+        help="Reuse results in .agree/cache for files whose content hasn't changed",
+    ),
+):
+    start = time.perf_counter()
+    seconds = parse_duration(timeout) if timeout else 0
+    deadline = start + seconds if seconds else None
+
+    file_paths, path_errors = collect_files(
+        [p for p in path if p != "-"], include, exclude
+    )
+    if changed_only:
+        changed = changed_files()
+        # without git we can't tell what changed, so fall back to everything
+        if changed is not None:
+            file_paths = [f for f in file_paths if f.resolve() in changed]
+    sources, skipped, read_errors = load_sources(
+        file_paths, max_file_size, skip_generated
+    )
+    errors = path_errors + read_errors
+    if "-" in path:
+        sources.insert(0, ("<stdin>", sys.stdin.read()))
+
+    results, unparsed = parse_sources(sources, auto_discover, jobs, deadline, cache)
+
+    index: dict = {}
+    # (target, class, kept entry, dropped entry) for class names seen twice
+    duplicates: List[Tuple[str, str, dict, dict]] = []
+    # classes per target counted before merging, so duplicates still pair up
+    class_counts: Counter = Counter()
+    for result, error in results:
+        if error is not None:
+            errors.append(error)
+        for target, classes in result.items():
+            class_counts[target] += len(classes)
+            merged = index.setdefault(target, {})
+            for class_name, entry in classes.items():
+                # classes are keyed by name, so a second file can't share the slot
+                if class_name in merged:
+                    duplicates.append((target, class_name, merged[class_name], entry))
+                    continue
+                merged[class_name] = entry
+
+    # before filtering, so --model on one side doesn't make a target look unpaired
+    unpaired_targets = {target for target, count in class_counts.items() if count == 1}
+
+    index = filter_index(index, split_patterns(model), split_patterns(field))
+
+    # sort targets and classes so output doesn't depend on which file or
+    # --path argument a class came from; fields keep declaration order
+    index = {
+        target: dict(sorted(classes.items()))
+        for target, classes in sorted(index.items())
+    }
+
+    end = time.perf_counter()
+
+    # stderr, so --json output stays parseable
+    if skipped:
+        typer.echo(f"Skipped {len(skipped)} file(s):", err=True)
+        for file_path, reason in skipped:
+            typer.echo(f"  {file_path} ({reason})", err=True)
+
+    # every path that was missing or couldn't be read or parsed, reported together
+    if errors:
+        typer.echo(f"{len(errors)} path(s) could not be read or parsed:", err=True)
+        for error in errors:
+            typer.echo(f"  {format_error(error)}", err=True)
+
+    # --timeout ran out, so the index only covers files parsed before it did
+    if unparsed:
+        typer.echo(
+            f"Incomplete: --timeout {timeout} reached, "
+            f"{len(unparsed)} file(s) not parsed:",
+            err=True,
+        )
+        for source_path in unparsed:
+            typer.echo(f"  {source_path}", err=True)
+
+    # the first file wins; the others must be renamed or given another target
+    for target, class_name, kept, dropped in duplicates:
+        typer.echo(
+            f"Error: {format_location(dropped['location'])}: '{class_name}' is "
+            f"already agreed under target '{target}' at "
+            f"{format_location(kept['location'])}",
+            err=True,
+        )
+
+    # a target with a single class has nothing to agree with
+    unpaired_entries = [
+        (target, class_name, entry)
+        for target, classes in index.items()
+        if target in unpaired_targets
+        for class_name, entry in classes.items()
+    ]
+    # --changed-only usually leaves a class's counterpart unparsed, and so can
+    # a timeout, so a missing pair there is expected and must not fail the run
+    if (changed_only or unparsed) and unpaired == UnpairedPolicy.error:
+        unpaired = UnpairedPolicy.warning
+    if unpaired_entries and unpaired != UnpairedPolicy.ignore:
+        label = "Error" if unpaired == UnpairedPolicy.error else "Warning"
+        for target, class_name, entry in unpaired_entries:
+            typer.echo(
+                f"{label}: {format_location(entry['location'])}: "
+                f"'{class_name}' is the only class agreed under target '{target}'",
+                err=True,
+            )
+
+    if json_output:
+        typer.echo(json.dumps(index, indent=2))
+    else:
+        elapsed = (end - start) * 1000  # ms
+        print(f"{elapsed:.5f} ms")
+        print(index)
+
+    # the index is incomplete, so don't let the run look like a success
+    if errors or duplicates or unparsed:
+        raise typer.Exit(code=1)
+    if unpaired_entries and unpaired == UnpairedPolicy.error:
+        raise typer.Exit(code=1)
 
 
 if __name__ == "__main__":
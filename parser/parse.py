@@ -3,25 +3,50 @@ import ast
 
 import libcst as cst
 import libcst.matchers as m
+from libcst.metadata import PositionProvider
 from libcst.display import dump
 from rich import print
 import time
 
-from parser.utils import map_sqlalchemy_type
+from parser.utils import (
+    AUTO_DISCOVER_BASES,
+    auto_target_name,
+    map_constrained_type,
+    map_pydantic_type,
+    map_sqlalchemy_type,
+)
 
 
-def parse_code(text: str) -> dict:
+# the agree(...) call used as a decorator
+AGREE_CALL = m.Call(func=m.Name("agree"))
+
+# a class decorated with @agree(...)
+AGREED_CLASS = m.ClassDef(
+    decorators=[
+        m.ZeroOrMore(),
+        m.Decorator(decorator=AGREE_CALL),
+        m.ZeroOrMore(),
+    ]
+)
+
+
+def parse_code(
+    text: str, auto_discover: bool = False, path: Optional[str] = None
+) -> dict:
     """
     Parse Python code and extract class information.
     
     Args:
         text: Python source code as a string
+        auto_discover: Also pick up undecorated BaseModel/Base subclasses,
+            targeted by their class name minus a Schema/Model suffix
+        path: File the code came from, recorded in each class location
         
     Returns:
         Dictionary mapping targets to classes and their fields
     """
-    root = cst.parse_module(text)
-    visitor = Visitor()
+    root = cst.MetadataWrapper(cst.parse_module(text))
+    visitor = Visitor(auto_discover=auto_discover, path=path)
     root.visit(visitor)
     return visitor.index
 
@@ -40,30 +65,62 @@ def get_ast(text: str):
 
 
 class Visitor(m.MatcherDecoratableVisitor):
-    def __init__(self) -> None:
+    METADATA_DEPENDENCIES = (PositionProvider,)
+
+    def __init__(
+        self, auto_discover: bool = False, path: Optional[str] = None
+    ) -> None:
         super().__init__()
+        self.auto_discover = auto_discover
+        self.path = path
         self.class_call_stack: list[str] = []
         # dict [target, dict[class, some obj]]
         # pls refactor into pydantic
         self.index: dict[str, dict[str, dict[str, Union[str, int, float]]]] = {}
         self.class_dict_stack: list[dict[str, Union[str, int, float]]] = []
+        # whether each enclosing class (or function, always False) is one we
+        # collect fields for; functions are pushed so their locals are skipped
+        self.class_agreed_stack: list[bool] = []
+        # every target each class on the stack is agreed under
+        self.class_targets_stack: list[list[str]] = []
 
     def visit_ClassDef(self, node: cst.ClassDef) -> Optional[bool]:
         self.class_call_stack.append(node.name.value)
-        self.class_dict_stack.append({})
+        self.class_dict_stack.append(
+            {"location": {"path": self.path, **self._position(node.name)}}
+        )
+        self.class_targets_stack.append([])
+
+        agreed = m.matches(node, AGREED_CLASS)
+        for decorator in node.decorators:
+            if m.matches(decorator.decorator, AGREE_CALL):
+                self._get_string_args(cst.ensure_type(decorator.decorator, cst.Call))
+        if not agreed and self.auto_discover:
+            base_names = {self._type_name(base.value) for base in node.bases}
+            agreed = bool(base_names & AUTO_DISCOVER_BASES)
+        self.class_agreed_stack.append(agreed)
 
     def leave_ClassDef(self, original_node: cst.ClassDef) -> None:
-        target = self.class_dict_stack[-1].get("target", None)
-        current_class = self.class_call_stack[-1]
+        current_class = self.class_call_stack.pop()
+        class_dict = self.class_dict_stack.pop()
+        targets = self.class_targets_stack.pop()
+        agreed = self.class_agreed_stack.pop()
 
-        if target is None:
-            return
+        # auto-discovered classes (or @agree() with no target) pair up by name
+        if not targets and agreed and self.auto_discover:
+            targets = [auto_target_name(current_class)]
+
+        # a class in several groups gets an entry under each target
+        for target in targets:
+            if self.index.get(target) is None:
+                self.index[target] = {}
+            self.index[target][current_class] = {"target": target, **class_dict}
+
+    def visit_FunctionDef(self, node: cst.FunctionDef) -> Optional[bool]:
+        self.class_agreed_stack.append(False)
 
-        if self.index.get(target) is None:
-            self.index[target] = {}
-        self.index[target][current_class] = self.class_dict_stack[-1]
-        self.class_call_stack.pop()
-        self.class_dict_stack.pop()
+    def leave_FunctionDef(self, original_node: cst.FunctionDef) -> None:
+        self.class_agreed_stack.pop()
 
     # onion
     #
@@ -73,43 +130,50 @@ class Visitor(m.MatcherDecoratableVisitor):
     #
     #
 
-    @m.call_if_inside(m.Call(m.Name("agree")))
-    @m.visit(m.Arg())
-    def _get_string_args(self, node: cst.Arg) -> None:
-        """
-        Gets all args for the agree decorator for a class
+    def _get_string_args(self, call: cst.Call) -> None:
         """
+        Gets all args for the agree decorator for a class.
+        Positional strings are shorthand for targets: @agree("event")
 
-        val = None
-        kw = None
-        if node.keyword is not None:
-            kw = node.keyword.value
-        if m.matches(node.value, m.SimpleString()):
-            raw = cst.ensure_type(node.value, cst.SimpleString).value
-            val = ast.literal_eval(raw)  # '"event"' → 'event'
-        elif m.matches(node.value, m.Integer()):
-            val = cst.ensure_type(node.value, cst.Integer).value
-
-        if val is None or kw is None:
-            return
-
-        self.class_dict_stack[-1][kw] = val
-
-    # fire only when we're inside a ClassDef that has @agree(...)
-    @m.call_if_inside(
-        m.ClassDef(
-            decorators=[
-                m.ZeroOrMore(),
-                m.Decorator(decorator=m.Call(func=m.Name("agree"))),
-                m.ZeroOrMore(),
-            ]
-        )
-    )
+        Only the decorator call's own args are read, so values nested in
+        other calls (e.g. policy=Policy("subset")) are ignored.
+        """
+        for arg in call.args:
+            val = None
+            kw = None
+            if arg.keyword is not None:
+                kw = arg.keyword.value
+            if m.matches(arg.value, m.SimpleString()):
+                raw = cst.ensure_type(arg.value, cst.SimpleString).value
+                val = ast.literal_eval(raw)  # '"event"' → 'event'
+                # b"..." evaluates to bytes, which can't be a target or JSON
+                if not isinstance(val, str):
+                    continue
+                if kw is None:
+                    kw = "target"
+            elif m.matches(arg.value, m.Integer()):
+                val = cst.ensure_type(arg.value, cst.Integer).value
+
+            if val is None or kw is None:
+                continue
+
+            # @agree("user", "user_public") puts the class in several groups
+            if kw == "target":
+                if val not in self.class_targets_stack[-1]:
+                    self.class_targets_stack[-1].append(val)
+                continue
+
+            self.class_dict_stack[-1][kw] = val
+
+    # only fires for fields of @agree(...) or auto-discovered classes
     def visit_Assign(self, node: cst.Assign) -> Optional[bool]:
         """
         Handle old-style SQLAlchemy Column() definitions.
         Example: id = Column(Integer, primary_key=True)
         """
+        if not self._in_agreed_class():
+            return
+
         # Get the target name
         target = None
         if len(node.targets) == 1:
@@ -117,6 +181,11 @@ class Visitor(m.MatcherDecoratableVisitor):
             if m.matches(assign_target.target, m.Name()):
                 target = cst.ensure_type(assign_target.target, cst.Name).value
 
+        # Keep the table name as class metadata rather than a field
+        if target == "__tablename__" and m.matches(node.value, m.SimpleString()):
+            raw = cst.ensure_type(node.value, cst.SimpleString).value
+            self.class_dict_stack[-1]["tablename"] = ast.literal_eval(raw)
+
         # Skip if target is __tablename__ or similar
         if target and target.startswith("__"):
             return
@@ -128,45 +197,33 @@ class Visitor(m.MatcherDecoratableVisitor):
         call = cst.ensure_type(node.value, cst.Call)
 
         # Extract SQLAlchemy type and nullable from Column() arguments
-        sqlalchemy_type = None
+        python_type = None
         nullable = False
 
         for arg in call.args:
             # First positional arg is usually the type
-            if arg.keyword is None and sqlalchemy_type is None:
-                if m.matches(arg.value, m.Name()):
-                    sqlalchemy_type = cst.ensure_type(arg.value, cst.Name).value
+            if arg.keyword is None and python_type is None:
+                python_type = self._extract_column_type(arg.value)
             # Check for nullable keyword argument
             elif arg.keyword and m.matches(arg.keyword, m.Name(value="nullable")):
                 if m.matches(arg.value, m.Name(value="True")):
                     nullable = True
 
-        if not sqlalchemy_type or not target:
+        if not python_type or not target:
             return
 
-        # Map SQLAlchemy type to Python type
-        python_type = map_sqlalchemy_type(sqlalchemy_type)
-
         # Build types list
         types = [python_type]
         if nullable:
             types.append("None")
 
         # Store in class dict
-        if "fields" not in self.class_dict_stack[-1]:
-            self.class_dict_stack[-1]["fields"] = {}
-        self.class_dict_stack[-1]["fields"][target] = types
-
-    @m.call_if_inside(
-        m.ClassDef(
-            decorators=[
-                m.ZeroOrMore(),
-                m.Decorator(decorator=m.Call(func=m.Name("agree"))),
-                m.ZeroOrMore(),
-            ]
-        )
-    )
+        assign_name = cst.ensure_type(node.targets[0].target, cst.Name)
+        self._add_field(target, types, assign_name)
+
     def visit_AnnAssign(self, node: cst.AnnAssign) -> Optional[bool]:
+        if not self._in_agreed_class():
+            return
 
         annotation, target = None, None
 
@@ -183,17 +240,105 @@ class Visitor(m.MatcherDecoratableVisitor):
 
         annotation_types = self._extract_from_annotation(actual_annotation)
 
+        # mapped_column(DateTime(timezone=True)) makes a Mapped[datetime] aware
+        if m.matches(node.value, m.Call(func=m.Name("mapped_column"))):
+            call = cst.ensure_type(node.value, cst.Call)
+            column_type = None
+            # skip a leading column name, e.g. mapped_column("created", DateTime(...))
+            for arg in call.args:
+                if arg.keyword is None and column_type is None:
+                    column_type = self._extract_column_type(arg.value)
+            if column_type == "datetime-tz":
+                annotation_types = [
+                    "datetime-tz" if t == "datetime" else t for t in annotation_types
+                ]
+
         # Store the information in the class dict
         if target and annotation_types:
             # For now, store the types list. Can be refined later based on needs
-            if "fields" not in self.class_dict_stack[-1]:
-                self.class_dict_stack[-1]["fields"] = {}
-            self.class_dict_stack[-1]["fields"][target] = annotation_types
+            self._add_field(target, annotation_types, node.target)
+
+    def _add_field(self, name: str, types: list[str], node: cst.CSTNode) -> None:
+        """
+        Record a field's types, and where it's declared, on the current class
+        """
+        class_dict = self.class_dict_stack[-1]
+        if "fields" not in class_dict:
+            class_dict["fields"] = {}
+            class_dict["field_locations"] = {}
+        class_dict["fields"][name] = types
+        class_dict["field_locations"][name] = self._position(node)
+
+    def _position(self, node: cst.CSTNode) -> dict[str, int]:
+        """
+        1-based line and column where a node starts
+        """
+        start = self.get_metadata(PositionProvider, node).start
+        return {"line": start.line, "column": start.column + 1}
+
+    def _in_agreed_class(self) -> bool:
+        """
+        Whether we're directly inside a class we collect fields for, either
+        decorated with @agree(...) or picked up by auto-discovery, and not
+        inside one of its methods.
+        """
+        return bool(self.class_agreed_stack) and self.class_agreed_stack[-1]
+
+    def _extract_column_type(self, node: cst.BaseExpression) -> Optional[str]:
+        """
+        Extract the Python type from a SQLAlchemy type passed to Column()
+        or mapped_column(), e.g. Integer, Numeric(10, 2) or
+        DateTime(timezone=True). Returns None if it isn't a type we can read.
+        """
+        type_name = self._type_name(node)
+        if type_name is not None:
+            return map_sqlalchemy_type(type_name)
+
+        # Parameterised types, e.g. Numeric(10, 2) or postgresql.UUID(as_uuid=True)
+        if m.matches(node, m.Call()):
+            call = cst.ensure_type(node, cst.Call)
+            type_name = self._type_name(call.func)
+            if type_name is None:
+                return None
+            python_type = map_sqlalchemy_type(type_name)
+
+            # DateTime(timezone=True) / TIMESTAMP(timezone=True) are tz-aware
+            if python_type == "datetime":
+                for arg in call.args:
+                    if m.matches(
+                        arg,
+                        m.Arg(keyword=m.Name("timezone"), value=m.Name("True")),
+                    ):
+                        return "datetime-tz"
+
+            # Numeric(..., asdecimal=False) hands back floats, not Decimals
+            if python_type == "Decimal":
+                for arg in call.args:
+                    if m.matches(
+                        arg,
+                        m.Arg(keyword=m.Name("asdecimal"), value=m.Name("False")),
+                    ):
+                        return "float"
+            return python_type
+
+        return None
+
+    def _type_name(self, node: cst.BaseExpression) -> Optional[str]:
+        """
+        Get the bare type name from a Name or dotted Attribute,
+        e.g. 'UUID' for both UUID and uuid.UUID. Returns None otherwise.
+        """
+        if m.matches(node, m.Name()):
+            return cst.ensure_type(node, cst.Name).value
+        if m.matches(node, m.Attribute()):
+            return cst.ensure_type(node, cst.Attribute).attr.value
+        return None
 
     def _extract_from_annotation(self, node: cst.BaseExpression) -> list[str]:
         """
         Recursively extract all type names from an annotation.
-        Handles Optional[x], Union[x, y, ...], x | y, and simple types.
+        Handles Optional[x], Union[x, y, ...], x | y, Annotated[x, ...],
+        constrained types like condecimal(...), and simple types.
         Returns a normalized list of type name strings.
         """
         if m.matches(node, m.Subscript()):
@@ -201,13 +346,16 @@ class Visitor(m.MatcherDecoratableVisitor):
             ann_base = subscript.value
 
             # Get the base type name (e.g., 'Optional', 'Union', 'List')
-            base_name = None
-            if m.matches(ann_base, m.Name()):
-                base_name = cst.ensure_type(ann_base, cst.Name).value
+            base_name = self._type_name(ann_base)
+
+            # Annotated[T, Field(...), ...] only describes T; the rest is metadata
+            slice_elements = subscript.slice
+            if base_name == "Annotated":
+                slice_elements = slice_elements[:1]
 
             # Extract types from all slice elements
             result_types = []
-            for slice_element in subscript.slice:
+            for slice_element in slice_elements:
                 if m.matches(slice_element, m.SubscriptElement()):
                     element = cst.ensure_type(slice_element, cst.SubscriptElement)
                     if m.matches(element.slice, m.Index()):
@@ -238,11 +386,20 @@ class Visitor(m.MatcherDecoratableVisitor):
             # If it's not BitOr, treat as unknown and return empty
             return []
 
+        elif m.matches(node, m.Call()):
+            # Pydantic constrained types, e.g. condecimal(max_digits=10)
+            # or pydantic.constr(max_length=8)
+            call = cst.ensure_type(node, cst.Call)
+            func_name = self._type_name(call.func)
+            constrained_type = map_constrained_type(func_name) if func_name else None
+            # any other call (Field(...), StringConstraints(...)) isn't a type
+            return [constrained_type] if constrained_type else []
+
         else:
-            # Base case: simple Name node (int, str, None, etc.)
-            if m.matches(node, m.Name()):
-                name_node = cst.ensure_type(node, cst.Name)
-                return [name_node.value]
+            # Base case: simple Name or dotted name (int, None, uuid.UUID, etc.)
+            type_name = self._type_name(node)
+            if type_name is not None:
+                return [map_pydantic_type(type_name)]
 
             # For any other type we don't handle, return empty list
             return []
@@ -1,5 +1,7 @@
 """Utility functions and mappings for parser"""
 
+from typing import Optional
+
 # SQLAlchemy type to Python type mapping
 SQLALCHEMY_TYPE_MAP = {
     # Integer types
@@ -17,9 +19,12 @@ SQLALCHEMY_TYPE_MAP = {
     
     # Float types
     "Float": "float",
-    "Numeric": "float",
-    "DECIMAL": "float",
     "REAL": "float",
+
+    # Decimal types (kept apart from float so money columns aren't lossy)
+    "Numeric": "Decimal",
+    "NUMERIC": "Decimal",
+    "DECIMAL": "Decimal",
     
     # Boolean
     "Boolean": "bool",
@@ -33,13 +38,48 @@ SQLALCHEMY_TYPE_MAP = {
     # Binary types
     "LargeBinary": "bytes",
     "BLOB": "bytes",
+    "BINARY": "bytes",
+    "VARBINARY": "bytes",
+    "BYTEA": "bytes",
     
+    # Identifier types
+    "Uuid": "UUID",
+    "UUID": "UUID",
+
     # JSON types
     "JSON": "dict",
     "JSONB": "dict",
 }
 
 
+# Pydantic-specific annotation types to their canonical name
+PYDANTIC_TYPE_MAP = {
+    # Timezone-aware datetimes are kept distinct from naive ones
+    "AwareDatetime": "datetime-tz",
+    "NaiveDatetime": "datetime",
+
+    # Versioned UUID types are all UUIDs
+    "UUID1": "UUID",
+    "UUID3": "UUID",
+    "UUID4": "UUID",
+    "UUID5": "UUID",
+
+    # Base64 types are validated from strings but hold the decoded value
+    "Base64Bytes": "bytes",
+    "Base64Str": "str",
+}
+
+
+# Pydantic constrained type functions to the Python type they constrain
+CONSTRAINED_TYPE_MAP = {
+    "conint": "int",
+    "confloat": "float",
+    "condecimal": "Decimal",
+    "constr": "str",
+    "conbytes": "bytes",
+}
+
+
 def map_sqlalchemy_type(sqlalchemy_type: str) -> str:
     """
     Maps a SQLAlchemy type to its Python equivalent.
@@ -51,3 +91,53 @@ def map_sqlalchemy_type(sqlalchemy_type: str) -> str:
         The corresponding Python type name (e.g., 'int', 'str')
     """
     return SQLALCHEMY_TYPE_MAP.get(sqlalchemy_type, sqlalchemy_type)
+
+
+def map_constrained_type(func_name: str) -> Optional[str]:
+    """
+    Maps a Pydantic constrained type function to its Python equivalent.
+
+    Args:
+        func_name: The function name (e.g., 'condecimal', 'constr')
+
+    Returns:
+        The constrained Python type name (e.g., 'Decimal', 'str'), or None
+        if the function isn't a known constrained type
+    """
+    return CONSTRAINED_TYPE_MAP.get(func_name)
+
+
+def map_pydantic_type(type_name: str) -> str:
+    """
+    Maps a Pydantic-specific annotation type to its canonical name.
+
+    Args:
+        type_name: The annotation type name (e.g., 'AwareDatetime', 'int')
+
+    Returns:
+        The canonical type name (e.g., 'datetime-tz'), or the input unchanged
+    """
+    return PYDANTIC_TYPE_MAP.get(type_name, type_name)
+
+
+# Base classes whose subclasses are picked up by auto-discovery
+AUTO_DISCOVER_BASES = {"BaseModel", "Base"}
+
+# Suffixes stripped from class names so e.g. UserSchema and UserModel pair up
+AUTO_DISCOVER_SUFFIXES = ("Schema", "Model")
+
+
+def auto_target_name(class_name: str) -> str:
+    """
+    Derives the target for an auto-discovered class from its name.
+
+    Args:
+        class_name: The class name (e.g., 'UserSchema', 'UserModel')
+
+    Returns:
+        The name with a known suffix stripped (e.g., 'User')
+    """
+    for suffix in AUTO_DISCOVER_SUFFIXES:
+        if class_name.endswith(suffix) and class_name != suffix:
+            return class_name[: -len(suffix)]
+    return class_name
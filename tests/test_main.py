@@ -0,0 +1,631 @@
+"""Unit tests for CLI helpers"""
+import json
+import os
+import subprocess
+import time
+
+import pytest
+import typer
+from typer.testing import CliRunner
+
+import main
+from main import (
+    cache_key,
+    changed_files,
+    collect_files,
+    filter_index,
+    format_error,
+    load_sources,
+    matches_any,
+    parse_duration,
+    parse_source,
+    parse_sources,
+    split_patterns,
+)
+
+# main() wrapped the same way typer.run() does, so options are parsed for real
+app = typer.Typer()
+app.command()(main.main)
+runner = CliRunner()
+
+
+def run_cli(*args, input=None):
+    """Run the CLI with --json plus the given arguments"""
+    return runner.invoke(app, ["--json", *(str(arg) for arg in args)], input=input)
+
+
+def write_pair(tmp_path, target="User"):
+    """Write a schema and a model agreed under the same target"""
+    tmp_path.mkdir(exist_ok=True)
+    (tmp_path / f"{target.lower()}_schema.py").write_text(
+        f'@agree("{target}")\n'
+        f"class {target}Schema(BaseModel):\n"
+        "    id: int\n"
+        "    email: str\n"
+    )
+    (tmp_path / f"{target.lower()}_model.py").write_text(
+        f'@agree("{target}")\n'
+        f"class {target}Model(Base):\n"
+        "    id = Column(Integer)\n"
+        "    email = Column(String)\n"
+    )
+
+
+class TestMatchesAny:
+    """Test glob matching of relative paths"""
+    
+    def test_double_star_matches_zero_directories(self):
+        """Test 'src/**/*.py' matches files directly under src"""
+        assert matches_any("src/a.py", ["src/**/*.py"])
+    
+    def test_double_star_matches_nested_directories(self):
+        """Test 'src/**/*.py' matches files at any depth under src"""
+        assert matches_any("src/pkg/b.py", ["src/**/*.py"])
+        assert matches_any("src/pkg/sub/c.py", ["src/**/*.py"])
+    
+    def test_single_star_stays_in_one_segment(self):
+        """Test '*' doesn't match across '/'"""
+        assert matches_any("src/a.py", ["src/*.py"])
+        assert not matches_any("src/pkg/b.py", ["src/*.py"])
+    
+    def test_leading_double_star(self):
+        """Test '**/x' matches at the root and below"""
+        assert matches_any("test_a.py", ["**/test_*.py"])
+        assert matches_any("tests/unit/test_a.py", ["**/test_*.py"])
+    
+    def test_pattern_without_slash_matches_any_component(self):
+        """Test bare patterns match file names and directory names"""
+        assert matches_any("src/pkg/b.py", ["*.py"])
+        assert matches_any("web/node_modules/x/index.py", ["node_modules"])
+        assert not matches_any("src/a.txt", ["*.py"])
+    
+    def test_character_classes(self):
+        """Test '[...]' and '[!...]' classes"""
+        assert matches_any("src/b.py", ["src/[!a]*.py"])
+        assert not matches_any("src/a.py", ["src/[!a]*.py"])
+        assert matches_any("src/a.py", ["src/[ab].py"])
+
+
+class TestCollectFiles:
+    """Test walking paths with include/exclude globs"""
+    
+    def make_tree(self, root):
+        for rel in [
+            "src/a.py",
+            "src/pkg/b.py",
+            "src/notes.txt",
+            "src/node_modules/c.py",
+            "venv/d.py",
+            "web/e.py",
+        ]:
+            path = root / rel
+            path.parent.mkdir(parents=True, exist_ok=True)
+            path.write_text("")
+    
+    def test_include_glob_with_double_star(self, tmp_path):
+        """Test 'src/**/*.py' picks up top-level and nested files under src"""
+        self.make_tree(tmp_path)
+        
+        files, errors = collect_files([str(tmp_path)], ["src/**/*.py"], [])
+        
+        assert [f.relative_to(tmp_path).as_posix() for f in files] == [
+            "src/a.py",
+            "src/pkg/b.py",
+        ]
+    
+    def test_default_excludes_and_extra_excludes(self, tmp_path):
+        """Test vendored dirs are always skipped and --exclude adds to them"""
+        self.make_tree(tmp_path)
+        
+        files, errors = collect_files([str(tmp_path)], ["*.py"], ["web"])
+        
+        assert [f.relative_to(tmp_path).as_posix() for f in files] == [
+            "src/a.py",
+            "src/pkg/b.py",
+        ]
+    
+    def test_explicit_file_always_kept(self, tmp_path):
+        """Test a file passed directly isn't filtered by include/exclude"""
+        self.make_tree(tmp_path)
+        notes = tmp_path / "src" / "notes.txt"
+        
+        files, errors = collect_files([str(notes)], ["*.py"], ["*.txt"])
+        
+        assert files == [notes]
+        assert errors == []
+    
+    def test_overlapping_paths_collected_once(self, tmp_path):
+        """Test a file reached from two --path arguments is only parsed once"""
+        self.make_tree(tmp_path)
+        
+        files, errors = collect_files(
+            [str(tmp_path / "src"), str(tmp_path / "src" / "a.py")], ["*.py"], []
+        )
+        
+        assert [f.relative_to(tmp_path).as_posix() for f in files] == [
+            "src/a.py",
+            "src/pkg/b.py",
+        ]
+    
+    def test_missing_path_is_an_error(self, tmp_path):
+        """Test a --path that doesn't exist is reported, not printed to stdout"""
+        missing = str(tmp_path / "nope")
+        
+        files, errors = collect_files([missing], ["*.py"], [])
+        
+        assert files == []
+        assert [format_error(e) for e in errors] == [f"{missing}: not found"]
+
+
+class TestChangedFiles:
+    """Test asking git which files changed"""
+    
+    def git(self, cwd, *args):
+        subprocess.run(
+            ["git", "-c", "user.name=test", "-c", "user.email=test@example.com", *args],
+            cwd=cwd,
+            check=True,
+            capture_output=True,
+        )
+    
+    def test_modified_and_untracked_files(self, tmp_path, monkeypatch):
+        """Test modified, untracked, and non-ASCII paths are all reported"""
+        self.git(tmp_path, "init", "-q")
+        (tmp_path / "clean.py").write_text("x = 1\n")
+        (tmp_path / "edited.py").write_text("x = 1\n")
+        self.git(tmp_path, "add", ".")
+        self.git(tmp_path, "commit", "-q", "-m", "init")
+        (tmp_path / "edited.py").write_text("x = 2\n")
+        (tmp_path / "é.py").write_text("x = 1\n")
+        monkeypatch.chdir(tmp_path)
+        
+        files = changed_files()
+        
+        assert files == {
+            (tmp_path / "edited.py").resolve(),
+            (tmp_path / "é.py").resolve(),
+        }
+    
+    def test_outside_a_repository(self, tmp_path, monkeypatch):
+        """Test None is returned when git can't answer"""
+        monkeypatch.chdir(tmp_path)
+        monkeypatch.setenv("GIT_CEILING_DIRECTORIES", str(tmp_path.parent))
+        
+        assert changed_files() is None
+
+
+class TestParseSource:
+    """Test per-file error handling when parsing"""
+    
+    def test_syntax_error_becomes_error_record(self):
+        """Test a syntax error is returned with its location instead of raised"""
+        result, error = parse_source(("bad.py", "class A(:\n    x\n"), False)
+        
+        assert result == {}
+        assert error["path"] == "bad.py"
+        assert error["line"] == 2
+        assert format_error(error).startswith("bad.py:2:")
+    
+    def test_other_exceptions_become_error_records(self, monkeypatch):
+        """Test any exception from the parser is confined to its file"""
+        def boom(*args):
+            raise IndexError("list index out of range")
+        
+        monkeypatch.setattr(main, "parse_code", boom)
+        result, error = parse_source(("odd.py", "x = 1\n"), False)
+        
+        assert result == {}
+        assert error["line"] is None
+        assert format_error(error) == "odd.py: IndexError: list index out of range"
+    
+    def test_valid_source(self):
+        """Test a file that parses returns its index and no error"""
+        code = '@agree("User")\nclass UserSchema(BaseModel):\n    id: int\n'
+        
+        result, error = parse_source(("ok.py", code), False)
+        
+        assert error is None
+        assert result["User"]["UserSchema"]["fields"] == {"id": ["int"]}
+
+
+class TestTimeout:
+    """Test the --timeout budget and partial results"""
+    
+    def test_parse_duration_units(self):
+        """Test bare seconds and s/m/h suffixes"""
+        assert parse_duration("90") == 90
+        assert parse_duration("60s") == 60
+        assert parse_duration("1.5m") == 90
+        assert parse_duration("1h") == 3600
+    
+    def test_parse_duration_rejects_garbage(self):
+        """Test values that aren't durations are a usage error"""
+        for value in ("soon", "-5s", "m"):
+            with pytest.raises(typer.BadParameter):
+                parse_duration(value)
+    
+    def test_past_deadline_leaves_sources_unparsed(self):
+        """Test nothing is parsed once the deadline has passed"""
+        sources = [("a.py", "x = 1\n"), ("b.py", "y = 2\n")]
+        
+        results, unparsed = parse_sources(sources, False, 1, time.perf_counter() - 1)
+        
+        assert results == []
+        assert unparsed == ["a.py", "b.py"]
+    
+    def test_no_deadline_parses_everything(self):
+        """Test every source is parsed, in order, without a deadline"""
+        code = '@agree("User")\nclass UserSchema(BaseModel):\n    id: int\n'
+        sources = [("a.py", code), ("b.py", "class A(:\n")]
+        
+        results, unparsed = parse_sources(sources, False, 2, None)
+        
+        assert unparsed == []
+        assert "User" in results[0][0]
+        assert results[1][1]["path"] == "b.py"
+    
+    def test_timeout_reports_incomplete_and_exits_1(self, tmp_path):
+        """Test an exceeded --timeout lists unparsed files and fails the run"""
+        write_pair(tmp_path)
+        
+        result = run_cli("-p", tmp_path, "--timeout", "0.000001s")
+        
+        assert result.exit_code == 1
+        assert json.loads(result.stdout) == {}
+        assert "Incomplete: --timeout 0.000001s reached, 2 file(s) not parsed:" in (
+            result.stderr
+        )
+        assert str(tmp_path / "user_model.py") in result.stderr
+    
+    def test_generous_timeout_is_complete(self, tmp_path):
+        """Test a run that finishes in time is unaffected"""
+        write_pair(tmp_path)
+        
+        result = run_cli("-p", tmp_path, "--timeout", "1m", "--unpaired", "error")
+        
+        assert result.exit_code == 0
+        assert list(json.loads(result.stdout)["User"]) == ["UserModel", "UserSchema"]
+        assert "Incomplete" not in result.stderr
+    
+    def test_invalid_timeout_is_a_usage_error(self, tmp_path):
+        """Test a malformed --timeout is rejected before scanning"""
+        result = run_cli("-p", tmp_path, "--timeout", "soon")
+        
+        assert result.exit_code == 2
+        assert "not a duration" in result.stderr
+
+
+class TestCache:
+    """Test reusing parse results with --cache"""
+    
+    def test_unchanged_files_not_reparsed(self, tmp_path, monkeypatch):
+        """Test a second run reads cached results instead of parsing again"""
+        monkeypatch.chdir(tmp_path)
+        write_pair(tmp_path / "src")
+        first = run_cli("-p", "src", "--cache")
+        
+        def boom(*args, **kwargs):
+            raise AssertionError("parsed a cached file")
+        
+        monkeypatch.setattr(main, "parse_source", boom)
+        second = run_cli("-p", "src", "--cache")
+        
+        assert second.exit_code == first.exit_code == 0
+        assert json.loads(second.stdout) == json.loads(first.stdout)
+        assert len(list((tmp_path / ".agree" / "cache").glob("*.json"))) == 2
+    
+    def test_changed_file_reparsed(self, tmp_path, monkeypatch):
+        """Test editing a file misses the cache and picks up the change"""
+        monkeypatch.chdir(tmp_path)
+        write_pair(tmp_path / "src")
+        run_cli("-p", "src", "--cache")
+        schema = tmp_path / "src" / "user_schema.py"
+        schema.write_text(schema.read_text() + "    name: str\n")
+        
+        result = run_cli("-p", "src", "--cache")
+        
+        fields = json.loads(result.stdout)["User"]["UserSchema"]["fields"]
+        assert list(fields) == ["id", "email", "name"]
+    
+    def test_key_covers_parser_options_and_path(self, monkeypatch):
+        """Test the parser version, --auto-discover, and path all change the key"""
+        source = ("a.py", "x = 1\n")
+        key = cache_key(source, False)
+        
+        assert cache_key(("b.py", "x = 1\n"), False) != key
+        assert cache_key(source, True) != key
+        monkeypatch.setattr(main, "parser_fingerprint", lambda: "other")
+        assert cache_key(source, False) != key
+    
+    def test_corrupt_entry_ignored(self, tmp_path, monkeypatch):
+        """Test an unreadable cache entry is parsed again and rewritten"""
+        monkeypatch.chdir(tmp_path)
+        write_pair(tmp_path / "src")
+        run_cli("-p", "src", "--cache")
+        for entry in (tmp_path / ".agree" / "cache").glob("*.json"):
+            entry.write_text("{not json")
+        
+        result = run_cli("-p", "src", "--cache")
+        
+        assert result.exit_code == 0
+        assert list(json.loads(result.stdout)["User"]) == ["UserModel", "UserSchema"]
+
+
+class TestLoadSources:
+    """Test reading files and sorting them into sources, skips, and errors"""
+    
+    def test_unreadable_file_is_an_error(self, tmp_path):
+        """Test a non-UTF-8 file becomes an error record, not a silent drop"""
+        good = tmp_path / "good.py"
+        good.write_text("x = 1\n")
+        bad = tmp_path / "bad.py"
+        bad.write_bytes(b"\xff\xfe\x00bad")
+        
+        sources, skipped, errors = load_sources([good, bad], 1.0, True)
+        
+        assert sources == [(str(good), "x = 1\n")]
+        assert skipped == []
+        assert [e["path"] for e in errors] == [str(bad)]
+        assert "could not read file" in errors[0]["message"]
+    
+    def test_dangling_symlink_is_an_error(self, tmp_path):
+        """Test a symlink to nowhere is reported instead of crashing the run"""
+        dangling = tmp_path / "dangling.py"
+        os.symlink(tmp_path / "missing.py", dangling)
+        
+        sources, skipped, errors = load_sources([dangling], 1.0, True)
+        
+        assert sources == []
+        assert skipped == []
+        assert [e["path"] for e in errors] == [str(dangling)]
+        assert "could not read file" in errors[0]["message"]
+    
+    def test_generated_and_large_files_skipped(self, tmp_path):
+        """Test generated headers and the size limit skip files with a reason"""
+        generated = tmp_path / "gen.py"
+        generated.write_text("# Code generated by protoc. DO NOT EDIT.\n")
+        large = tmp_path / "large.py"
+        large.write_text("x = 1\n" * 1000)
+        
+        sources, skipped, errors = load_sources([generated, large], 0.001, True)
+        
+        assert sources == []
+        assert errors == []
+        assert skipped == [(generated, "generated"), (large, "larger than 0.001 MB")]
+
+
+class TestSplitPatterns:
+    """Test flattening repeatable, comma-separated option values"""
+    
+    def test_commas_and_repeats_flatten(self):
+        """Test 'User,Inv*' and a repeated option give one flat list"""
+        assert split_patterns(["User,Inv*", "Order"]) == ["User", "Inv*", "Order"]
+    
+    def test_blanks_dropped(self):
+        """Test whitespace and empty entries are ignored"""
+        assert split_patterns([" User , ,", ""]) == ["User"]
+
+
+class TestFilterIndex:
+    """Test narrowing the index with --model and --field globs"""
+    
+    INDEX = {
+        "User": {
+            "UserSchema": {
+                "target": "User",
+                "fields": {"id": ["int"], "email": ["str"], "created_at": ["datetime"]},
+                "field_locations": {
+                    "id": {"line": 3, "column": 4},
+                    "email": {"line": 4, "column": 4},
+                    "created_at": {"line": 5, "column": 4},
+                },
+            },
+        },
+        "Invoice": {
+            "InvoiceModel": {"target": "Invoice", "fields": {"id": ["int"]}},
+        },
+    }
+    
+    def test_empty_patterns_keep_everything(self):
+        """Test no --model or --field leaves the index untouched"""
+        assert filter_index(self.INDEX, [], []) == self.INDEX
+    
+    def test_model_globs_match_target_or_class(self):
+        """Test a model glob can match either the target or the class name"""
+        assert list(filter_index(self.INDEX, ["Inv*"], [])) == ["Invoice"]
+        assert list(filter_index(self.INDEX, ["*Schema"], [])) == ["User"]
+    
+    def test_field_globs_narrow_fields_and_locations(self):
+        """Test --field narrows both fields and field_locations"""
+        entry = filter_index(self.INDEX, ["User"], ["email", "*_at"])["User"][
+            "UserSchema"
+        ]
+        
+        assert list(entry["fields"]) == ["email", "created_at"]
+        assert list(entry["field_locations"]) == ["email", "created_at"]
+        # the original index isn't modified
+        assert "id" in self.INDEX["User"]["UserSchema"]["fields"]
+
+
+class TestMainErrors:
+    """Test errors are aggregated on stderr and fail the run"""
+    
+    def test_errors_reported_together_and_exit_1(self, tmp_path):
+        """Test read and parse errors share one stderr block and exit 1"""
+        (tmp_path / "ok.py").write_text(
+            '@agree("User")\nclass UserSchema(BaseModel):\n    id: int\n'
+        )
+        (tmp_path / "syntax.py").write_text("class A(:\n")
+        (tmp_path / "binary.py").write_bytes(b"\xff\xfe")
+        
+        result = run_cli("-p", tmp_path)
+        
+        assert result.exit_code == 1
+        assert "2 path(s) could not be read or parsed:" in result.stderr
+        assert "binary.py: could not read file" in result.stderr
+        assert "syntax.py:" in result.stderr
+        # the rest of the scan still produces JSON on stdout
+        assert "UserSchema" in json.loads(result.stdout)["User"]
+    
+    def test_missing_path_keeps_json_clean_and_exits_1(self, tmp_path):
+        """Test a missing --path goes to stderr, leaving stdout valid JSON"""
+        result = run_cli("-p", tmp_path / "nope")
+        
+        assert result.exit_code == 1
+        assert json.loads(result.stdout) == {}
+        assert "nope: not found" in result.stderr
+    
+    def test_same_class_in_two_files_reported(self, tmp_path):
+        """Test a class name agreed twice under one target isn't dropped silently"""
+        for service in ("service_a", "service_b"):
+            (tmp_path / service).mkdir()
+            (tmp_path / service / "m.py").write_text(
+                '@agree("User")\nclass UserSchema(BaseModel):\n    id: int\n'
+            )
+        
+        result = run_cli("-p", tmp_path / "service_a", "-p", tmp_path / "service_b")
+        
+        assert result.exit_code == 1
+        index = json.loads(result.stdout)
+        assert index["User"]["UserSchema"]["location"]["path"].startswith(
+            str(tmp_path / "service_a")
+        )
+        assert (
+            f"Error: {tmp_path / 'service_b' / 'm.py'}:2:7: 'UserSchema' is already "
+            f"agreed under target 'User' at {tmp_path / 'service_a' / 'm.py'}:2:7"
+            in result.stderr
+        )
+        # the two classes still pair with each other
+        assert "is the only class" not in result.stderr
+
+
+class TestUnpaired:
+    """Test the --unpaired policy for targets with a single class"""
+    
+    def write_lonely(self, tmp_path):
+        """Write a schema whose target has no model"""
+        (tmp_path / "order.py").write_text(
+            '@agree("Order")\nclass OrderSchema(BaseModel):\n    id: int\n'
+        )
+    
+    def test_warning_by_default_and_exits_0(self, tmp_path):
+        """Test the default warning policy reports the class but succeeds"""
+        self.write_lonely(tmp_path)
+        
+        result = run_cli("-p", tmp_path)
+        
+        assert result.exit_code == 0
+        assert "Warning:" in result.stderr
+        assert (
+            "'OrderSchema' is the only class agreed under target 'Order'"
+            in result.stderr
+        )
+    
+    def test_error_exits_1(self, tmp_path):
+        """Test the error policy fails the run"""
+        self.write_lonely(tmp_path)
+        
+        result = run_cli("-p", tmp_path, "--unpaired", "error")
+        
+        assert result.exit_code == 1
+        assert "Error:" in result.stderr
+    
+    def test_ignore_is_silent(self, tmp_path):
+        """Test the ignore policy reports nothing"""
+        self.write_lonely(tmp_path)
+        
+        result = run_cli("-p", tmp_path, "--unpaired", "ignore")
+        
+        assert result.exit_code == 0
+        assert result.stderr == ""
+    
+    def test_unknown_policy_rejected(self, tmp_path):
+        """Test --unpaired only accepts error, warning, or ignore"""
+        result = run_cli("-p", tmp_path, "--unpaired", "fatal")
+        
+        assert result.exit_code == 2
+    
+    def test_model_filter_does_not_unpair(self, tmp_path):
+        """Test --model on one side of a pair doesn't make the target unpaired"""
+        write_pair(tmp_path)
+        
+        result = run_cli(
+            "-p", tmp_path, "--model", "UserSchema", "--unpaired", "error"
+        )
+        
+        assert result.exit_code == 0
+        assert list(json.loads(result.stdout)["User"]) == ["UserSchema"]
+        assert result.stderr == ""
+    
+    def test_changed_only_downgrades_error_to_warning(self, tmp_path, monkeypatch):
+        """Test --changed-only doesn't fail on a counterpart that wasn't parsed"""
+        write_pair(tmp_path)
+        schema = tmp_path / "user_schema.py"
+        monkeypatch.setattr(main, "changed_files", lambda: {schema.resolve()})
+        
+        result = run_cli("-p", tmp_path, "--changed-only", "--unpaired", "error")
+        
+        assert result.exit_code == 0
+        assert list(json.loads(result.stdout)["User"]) == ["UserSchema"]
+        assert "Warning:" in result.stderr
+        assert "Error:" not in result.stderr
+
+
+class TestMainOutput:
+    """Test the JSON index printed by main()"""
+    
+    def test_output_sorted_regardless_of_path_order(self, tmp_path):
+        """Test targets and classes are sorted whatever order files are given in"""
+        write_pair(tmp_path, "User")
+        write_pair(tmp_path, "Invoice")
+        paths = []
+        for file_path in sorted(tmp_path.iterdir(), reverse=True):
+            paths += ["-p", file_path]
+        
+        result = run_cli(*paths)
+        
+        index = json.loads(result.stdout)
+        assert list(index) == ["Invoice", "User"]
+        assert list(index["User"]) == ["UserModel", "UserSchema"]
+        # fields keep declaration order
+        assert list(index["User"]["UserSchema"]["fields"]) == ["id", "email"]
+    
+    def test_comma_separated_model_and_field_options(self, tmp_path):
+        """Test --model and --field take comma lists and can be repeated"""
+        write_pair(tmp_path, "User")
+        write_pair(tmp_path, "Invoice")
+        write_pair(tmp_path, "Order")
+        
+        result = run_cli(
+            "-p", tmp_path, "--model", "User,Inv*", "--model", "Nope", "--field", "em*"
+        )
+        
+        index = json.loads(result.stdout)
+        assert list(index) == ["Invoice", "User"]
+        assert index["User"]["UserSchema"]["fields"] == {"email": ["str"]}
+    
+    def test_stdin_source(self, tmp_path):
+        """Test '-p -' parses stdin and records '<stdin>' as the location"""
+        code = '@agree("User")\nclass UserSchema(BaseModel):\n    id: int\n'
+        
+        result = run_cli("-p", "-", "--unpaired", "ignore", input=code)
+        
+        assert result.exit_code == 0
+        entry = json.loads(result.stdout)["User"]["UserSchema"]
+        assert entry["location"] == {"path": "<stdin>", "line": 2, "column": 7}
+        assert entry["fields"] == {"id": ["int"]}
+    
+    def test_jobs_match_sequential_run(self, tmp_path):
+        """Test parsing in a process pool gives the same index as one process"""
+        for target in ("User", "Invoice", "Order", "Account"):
+            write_pair(tmp_path, target)
+        (tmp_path / "syntax.py").write_text("class A(:\n")
+        
+        sequential = run_cli("-p", tmp_path)
+        pooled = run_cli("-p", tmp_path, "--jobs", "2")
+        
+        assert pooled.exit_code == sequential.exit_code == 1
+        assert json.loads(pooled.stdout) == json.loads(sequential.stdout)
+        assert len(json.loads(pooled.stdout)) == 4
+        assert pooled.stderr == sequential.stderr
+
@@ -104,6 +104,130 @@ class ComplexSchema(BaseModel):
             "nested": ["int", "str", "None"],
             "multi": ["int", "str", "float", "bool"],
         }
+    
+    def test_pydantic_aware_datetime(self):
+        """Test Pydantic AwareDatetime is distinct from naive datetime"""
+        code = '''
+from datetime import datetime
+from pydantic import AwareDatetime, BaseModel, NaiveDatetime
+
+@agree(target="Event")
+class EventSchema(BaseModel):
+    created_at: AwareDatetime
+    local_at: NaiveDatetime
+    plain_at: datetime
+'''
+        result = parse_code(code)
+        
+        assert result["Event"]["EventSchema"]["fields"] == {
+            "created_at": ["datetime-tz"],
+            "local_at": ["datetime"],
+            "plain_at": ["datetime"],
+        }
+    
+    def test_pydantic_base64_types(self):
+        """Test Pydantic base64 types map to the decoded type"""
+        code = '''
+from typing import Optional
+from pydantic import Base64Bytes, Base64Str, BaseModel
+
+@agree(target="File")
+class FileSchema(BaseModel):
+    content: Base64Bytes
+    thumbnail: Optional[Base64Bytes]
+    label: Base64Str
+'''
+        result = parse_code(code)
+        
+        assert result["File"]["FileSchema"]["fields"] == {
+            "content": ["bytes"],
+            "thumbnail": ["bytes", "None"],
+            "label": ["str"],
+        }
+    
+    def test_pydantic_uuid_types(self):
+        """Test plain, dotted, and versioned UUID annotations all map to UUID"""
+        code = '''
+import uuid
+from typing import Optional
+from uuid import UUID
+from pydantic import BaseModel, UUID4
+
+@agree(target="Account")
+class AccountSchema(BaseModel):
+    id: UUID4
+    owner_id: uuid.UUID
+    parent_id: Optional[UUID]
+'''
+        result = parse_code(code)
+        
+        assert result["Account"]["AccountSchema"]["fields"] == {
+            "id": ["UUID"],
+            "owner_id": ["UUID"],
+            "parent_id": ["UUID", "None"],
+        }
+    
+    def test_pydantic_constrained_types(self):
+        """Test Pydantic constrained types map to the type they constrain"""
+        code = '''
+from decimal import Decimal
+from typing import Optional
+from pydantic import BaseModel, condecimal, constr
+
+@agree(target="Invoice")
+class InvoiceSchema(BaseModel):
+    total: condecimal(max_digits=10, decimal_places=2)
+    tax: Optional[Decimal]
+    code: constr(max_length=8)
+'''
+        result = parse_code(code)
+        
+        assert result["Invoice"]["InvoiceSchema"]["fields"] == {
+            "total": ["Decimal"],
+            "tax": ["Decimal", "None"],
+            "code": ["str"],
+        }
+    
+    def test_pydantic_dotted_constrained_types(self):
+        """Test constrained types called through the module, e.g. pydantic.constr"""
+        code = '''
+import pydantic
+
+@agree(target="Invoice")
+class InvoiceSchema(pydantic.BaseModel):
+    total: pydantic.condecimal(max_digits=10, decimal_places=2)
+    code: pydantic.constr(max_length=8)
+    note: pydantic.Field(default="")
+'''
+        result = parse_code(code)
+        
+        assert result["Invoice"]["InvoiceSchema"]["fields"] == {
+            "total": ["Decimal"],
+            "code": ["str"],
+        }
+
+    
+    def test_pydantic_annotated_metadata_ignored(self):
+        """Test Annotated metadata like Field(...) isn't treated as a type"""
+        code = '''
+from typing import Annotated, Optional
+from pydantic import BaseModel, Field, StringConstraints
+
+@agree(target="User")
+class UserSchema(BaseModel):
+    age: Annotated[int, Field(gt=0)]
+    name: Annotated[str, StringConstraints(max_length=8)]
+    nick: Optional[Annotated[str, Field(min_length=1)]]
+    score: Annotated[float, "not a type"] = Field(default=0)
+'''
+        result = parse_code(code)
+        
+        assert result["User"]["UserSchema"]["fields"] == {
+            "age": ["int"],
+            "name": ["str"],
+            "nick": ["str", "None"],
+            "score": ["float"],
+        }
 
 
 class TestSQLAlchemyNewStyle:
@@ -190,6 +314,53 @@ class EventModel(Base):
             "updated_at": ["datetime", "None"],
         }
 
+    
+    def test_mapped_timezone_aware_datetime(self):
+        """Test mapped_column(DateTime(timezone=True)) marks datetime as tz-aware"""
+        code = '''
+from datetime import datetime
+from sqlalchemy import DateTime
+from sqlalchemy.orm import DeclarativeBase, Mapped, mapped_column
+
+class Base(DeclarativeBase):
+    pass
+
+@agree(target="Event")
+class EventModel(Base):
+    __tablename__ = "event"
+    
+    created_at: Mapped[datetime] = mapped_column(DateTime(timezone=True))
+    local_at: Mapped[datetime] = mapped_column(DateTime)
+'''
+        result = parse_code(code)
+        
+        assert result["Event"]["EventModel"]["fields"] == {
+            "created_at": ["datetime-tz"],
+            "local_at": ["datetime"],
+        }
+    
+    def test_mapped_timezone_aware_datetime_with_column_name(self):
+        """Test an explicit column name before the type doesn't hide timezone=True"""
+        code = '''
+from datetime import datetime
+from sqlalchemy import DateTime
+from sqlalchemy.orm import DeclarativeBase, Mapped, mapped_column
+
+class Base(DeclarativeBase):
+    pass
+
+@agree(target="Event")
+class EventModel(Base):
+    __tablename__ = "event"
+    
+    created_at: Mapped[datetime] = mapped_column("created", DateTime(timezone=True))
+'''
+        result = parse_code(code)
+        
+        assert result["Event"]["EventModel"]["fields"] == {
+            "created_at": ["datetime-tz"],
+        }
+
 
 class TestSQLAlchemyOldStyle:
     """Test parsing of old-style SQLAlchemy models with Column()"""
@@ -285,6 +456,115 @@ class AllTypesModel(Base):
             "json_field": ["dict"],
         }
     
+    def test_column_decimal_types(self):
+        """Test that Numeric/DECIMAL columns map to Decimal, not float"""
+        code = '''
+from sqlalchemy import Column, Integer, Numeric, DECIMAL, Float
+from sqlalchemy.orm import DeclarativeBase
+
+class Base(DeclarativeBase):
+    pass
+
+@agree(target="Invoice")
+class InvoiceModel(Base):
+    __tablename__ = "invoice"
+    
+    id = Column(Integer, primary_key=True)
+    total = Column(Numeric(10, 2))
+    tax = Column(DECIMAL, nullable=True)
+    rate = Column(Float)
+    ratio = Column(Numeric(5, 4, asdecimal=False))
+'''
+        result = parse_code(code)
+        
+        assert result["Invoice"]["InvoiceModel"]["fields"] == {
+            "id": ["int"],
+            "total": ["Decimal"],
+            "tax": ["Decimal", "None"],
+            "rate": ["float"],
+            "ratio": ["float"],
+        }
+    
+    def test_column_timezone_aware_datetime(self):
+        """Test DateTime(timezone=True) columns are distinct from naive ones"""
+        code = '''
+from sqlalchemy import Column, DateTime, TIMESTAMP
+from sqlalchemy.orm import DeclarativeBase
+
+class Base(DeclarativeBase):
+    pass
+
+@agree(target="Event")
+class EventModel(Base):
+    __tablename__ = "event"
+    
+    created_at = Column(DateTime(timezone=True))
+    stamped_at = Column(TIMESTAMP(timezone=True), nullable=True)
+    local_at = Column(DateTime(timezone=False))
+'''
+        result = parse_code(code)
+        
+        assert result["Event"]["EventModel"]["fields"] == {
+            "created_at": ["datetime-tz"],
+            "stamped_at": ["datetime-tz", "None"],
+            "local_at": ["datetime"],
+        }
+    
+    def test_column_binary_types(self):
+        """Test binary column types all map to bytes"""
+        code = '''
+from sqlalchemy import Column, LargeBinary, BINARY, VARBINARY
+from sqlalchemy.dialects.postgresql import BYTEA
+from sqlalchemy.orm import DeclarativeBase
+
+class Base(DeclarativeBase):
+    pass
+
+@agree(target="File")
+class FileModel(Base):
+    __tablename__ = "file"
+    
+    content = Column(LargeBinary)
+    digest = Column(BINARY(32))
+    thumbnail = Column(VARBINARY(1024), nullable=True)
+    raw = Column(BYTEA)
+'''
+        result = parse_code(code)
+        
+        assert result["File"]["FileModel"]["fields"] == {
+            "content": ["bytes"],
+            "digest": ["bytes"],
+            "thumbnail": ["bytes", "None"],
+            "raw": ["bytes"],
+        }
+    
+    def test_column_uuid_types(self):
+        """Test Uuid and dialect UUID columns map to UUID"""
+        code = '''
+import sqlalchemy as sa
+from sqlalchemy import Column, Uuid
+from sqlalchemy.dialects import postgresql
+from sqlalchemy.orm import DeclarativeBase
+
+class Base(DeclarativeBase):
+    pass
+
+@agree(target="Account")
+class AccountModel(Base):
+    __tablename__ = "account"
+    
+    id = Column(Uuid, primary_key=True)
+    owner_id = Column(postgresql.UUID(as_uuid=True))
+    name = Column(sa.String, nullable=True)
+'''
+        result = parse_code(code)
+        
+        assert result["Account"]["AccountModel"]["fields"] == {
+            "id": ["UUID"],
+            "owner_id": ["UUID"],
+            "name": ["str", "None"],
+        }
+    
     def test_column_skips_tablename(self):
         """Test that __tablename__ is properly skipped"""
         code = '''
@@ -305,6 +585,30 @@ class TestModel(Base):
         # Should only have 'id' field, not '__tablename__'
         assert "__tablename__" not in result["Test"]["TestModel"]["fields"]
         assert result["Test"]["TestModel"]["fields"] == {"id": ["int"]}
+    
+    def test_tablename_recorded_as_metadata(self):
+        """Test that __tablename__ is kept on the class entry, not as a field"""
+        code = '''
+from sqlalchemy import Column, Integer
+from sqlalchemy.orm import DeclarativeBase, Mapped
+
+class Base(DeclarativeBase):
+    pass
+
+@agree(target="User")
+class UserModelOld(Base):
+    __tablename__ = "users"
+    id = Column(Integer)
+
+@agree(target="User")
+class UserModelNew(Base):
+    __tablename__ = "app_users"
+    id: Mapped[int]
+'''
+        result = parse_code(code)
+        
+        assert result["User"]["UserModelOld"]["tablename"] == "users"
+        assert result["User"]["UserModelNew"]["tablename"] == "app_users"
 
 
 class TestMixedStyles:
@@ -425,6 +729,50 @@ class EmptySchema(BaseModel):
         fields = result["Empty"]["EmptySchema"].get("fields", {})
         assert len(fields) == 0
     
+    def test_nested_class_inside_agreed_class(self):
+        """Test a nested class (e.g. Pydantic Config) doesn't swallow the outer class"""
+        code = '''
+from pydantic import BaseModel
+
+@agree(target="User")
+class UserSchema(BaseModel):
+    id: int
+
+    class Config:
+        orm_mode = True
+
+    name: str
+'''
+        result = parse_code(code)
+        
+        assert result["User"]["UserSchema"]["fields"] == {
+            "id": ["int"],
+            "name": ["str"],
+        }
+    
+    def test_method_locals_not_fields(self):
+        """Test annotated assignments inside methods aren't indexed as fields"""
+        code = '''
+from pydantic import BaseModel
+
+@agree(target="User")
+class UserSchema(BaseModel):
+    id: int
+
+    def display(self) -> str:
+        tmp: str = "a"
+        total = Column(Integer)
+        return tmp
+
+    name: str
+'''
+        result = parse_code(code)
+        
+        assert result["User"]["UserSchema"]["fields"] == {
+            "id": ["int"],
+            "name": ["str"],
+        }
+    
     def test_large_union(self):
         """Test handling of large union types"""
         code = '''
@@ -473,6 +821,105 @@ class MySchema(BaseModel):
         assert "CustomTarget" in result
         assert result["CustomTarget"]["MySchema"]["target"] == "CustomTarget"
     
+    def test_positional_target(self):
+        """Test that a positional string is shorthand for target"""
+        code = '''
+from pydantic import BaseModel
+
+@agree("User", fidelity=2)
+class UserSchema(BaseModel):
+    id: int
+'''
+        result = parse_code(code)
+        
+        assert result["User"]["UserSchema"]["target"] == "User"
+        assert result["User"]["UserSchema"]["fidelity"] == "2"
+        assert result["User"]["UserSchema"]["fields"] == {"id": ["int"]}
+    
+    def test_agree_outside_class_decorators_ignored(self):
+        """Test agree(...) on functions or called directly doesn't crash or index"""
+        code = '''
+from pydantic import BaseModel
+
+@agree("user")
+def build_user():
+    pass
+
+class UserSchema(BaseModel):
+    id: int
+
+agree("x")(UserSchema)
+'''
+        result = parse_code(code)
+        
+        assert result == {}
+    
+    def test_nested_call_strings_not_targets(self):
+        """Test strings inside calls nested in the decorator aren't targets"""
+        code = '''
+from pydantic import BaseModel
+
+@agree("User", policy=Policy("subset"))
+class UserSchema(BaseModel):
+    id: int
+'''
+        result = parse_code(code)
+        
+        assert list(result) == ["User"]
+        assert "policy" not in result["User"]["UserSchema"]
+    
+    def test_agree_on_method_not_applied_to_class(self):
+        """Test @agree on a method doesn't tag the enclosing class"""
+        code = '''
+from pydantic import BaseModel
+
+class UserSchema(BaseModel):
+    id: int
+
+    @agree("x")
+    def helper(self):
+        pass
+'''
+        result = parse_code(code)
+        
+        assert result == {}
+    
+    def test_bytes_literals_ignored(self):
+        """Test b"..." args are neither targets nor parameters"""
+        code = '''
+from pydantic import BaseModel
+
+@agree(b"Account", "User", note=b"x")
+class UserSchema(BaseModel):
+    id: int
+'''
+        result = parse_code(code)
+        
+        assert list(result) == ["User"]
+        assert "note" not in result["User"]["UserSchema"]
+    
+    def test_multiple_targets_per_class(self):
+        """Test a class listed under several targets appears in each group"""
+        code = '''
+from pydantic import BaseModel
+
+@agree("User", "UserPublic", fidelity=2)
+class UserSchema(BaseModel):
+    id: int
+    name: str
+'''
+        result = parse_code(code)
+        
+        assert list(result) == ["User", "UserPublic"]
+        assert result["User"]["UserSchema"]["target"] == "User"
+        assert result["UserPublic"]["UserSchema"]["target"] == "UserPublic"
+        for target in ("User", "UserPublic"):
+            assert result[target]["UserSchema"]["fidelity"] == "2"
+            assert result[target]["UserSchema"]["fields"] == {
+                "id": ["int"],
+                "name": ["str"],
+            }
+    
     def test_multiple_decorator_args(self):
         """Test @agree with multiple parameters"""
         code = '''
@@ -487,3 +934,101 @@ class UserSchema(BaseModel):
         assert result["User"]["UserSchema"]["target"] == "User"
         # fidelity is stored as string representation of the integer
         assert result["User"]["UserSchema"]["fidelity"] == "2"
+
+
+class TestAutoDiscover:
+    """Test auto-discovery of undecorated models"""
+    
+    def test_undecorated_models_ignored_by_default(self):
+        """Test that undecorated models are not picked up without auto_discover"""
+        code = '''
+from pydantic import BaseModel
+
+class UserSchema(BaseModel):
+    id: int
+'''
+        result = parse_code(code)
+        
+        assert result == {}
+    
+    def test_models_paired_by_name(self):
+        """Test BaseModel and Base subclasses pair up by name minus Schema/Model"""
+        code = '''
+from sqlalchemy import Column, Integer, String
+from sqlalchemy.orm import DeclarativeBase
+from pydantic import BaseModel
+
+class Base(DeclarativeBase):
+    pass
+
+class UserSchema(BaseModel):
+    id: int
+    name: str
+
+class UserModel(Base):
+    __tablename__ = "user"
+    id = Column(Integer)
+    name = Column(String)
+
+class Helper:
+    value: int
+'''
+        result = parse_code(code, auto_discover=True)
+        
+        assert list(result) == ["User"]
+        assert result["User"]["UserSchema"]["target"] == "User"
+        assert result["User"]["UserSchema"]["fields"] == {
+            "id": ["int"],
+            "name": ["str"],
+        }
+        assert result["User"]["UserModel"]["fields"] == {
+            "id": ["int"],
+            "name": ["str"],
+        }
+    
+    def test_decorator_target_takes_precedence(self):
+        """Test that an explicit @agree target wins over the derived name"""
+        code = '''
+from pydantic import BaseModel
+
+@agree(target="Account")
+class UserSchema(BaseModel):
+    id: int
+'''
+        result = parse_code(code, auto_discover=True)
+        
+        assert list(result) == ["Account"]
+        assert result["Account"]["UserSchema"]["fields"] == {"id": ["int"]}
+
+
+class TestLocations:
+    """Test source locations recorded for classes and fields"""
+    
+    def test_class_and_field_locations(self):
+        """Test 1-based line/column for the class name and each field"""
+        code = '''from pydantic import BaseModel
+
+@agree(target="User")
+class UserSchema(BaseModel):
+    id: int
+    name = Column(String)
+'''
+        result = parse_code(code, path="schemas/user.py")
+        
+        entry = result["User"]["UserSchema"]
+        assert entry["location"] == {"path": "schemas/user.py", "line": 4, "column": 7}
+        assert entry["field_locations"] == {
+            "id": {"line": 5, "column": 5},
+            "name": {"line": 6, "column": 5},
+        }
+    
+    def test_location_without_path(self):
+        """Test that path is None when parsing code that isn't from a file"""
+        code = '''
+@agree(target="User")
+class UserSchema(BaseModel):
+    id: int
+'''
+        result = parse_code(code)
+        
+        assert result["User"]["UserSchema"]["location"]["path"] is None